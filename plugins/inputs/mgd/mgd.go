@@ -7,15 +7,37 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
-	"time"
 	"strings"
+	"sync"
+	"time"
+
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/plugins/common/tls"
 	"github.com/influxdata/telegraf/plugins/inputs"
 )
 
 // Mgd is a mgd plugin
 type Mgd struct {
 	Servers []string
+
+	Scheme   string        `toml:"scheme"`
+	Username config.Secret `toml:"username"`
+	Password config.Secret `toml:"password"`
+
+	tls.ClientConfig
+
+	// ResponseTimeout bounds how long we wait on a single server before
+	// giving up, so a hung mgd can't stall the whole collection interval.
+	ResponseTimeout config.Duration `toml:"response_timeout"`
+
+	// Percentiles is the set of tr-percentiles keys to emit as the
+	// upstream_latency / downsteram_latency histogram fields.
+	Percentiles []string `toml:"percentiles"`
+
+	Log telegraf.Logger `toml:"-"`
+
+	client *http.Client
 }
 
 type ServerStatus struct {
@@ -23,22 +45,164 @@ type ServerStatus struct {
 	StartAt int    `json:"start-at"`
 }
 
+// InverseStream is a single entry of the "inversestream" array. Fields that
+// get cast to int are decoded as *float64 so a missing or null value
+// comes through as nil instead of panicking the whole agent. A value of
+// another JSON type fails decoding of the whole response.
+type InverseStream struct {
+	Name            string      `json:"name"`
+	OK              interface{} `json:"ok"`
+	Jobs            interface{} `json:"jobs"`
+	OneMinute       *float64    `json:"one-minute"`
+	FiveMinute      *float64    `json:"five-minute"`
+	FifteenMinute   *float64    `json:"fifteen-minute"`
+	SwOneMinute     *float64    `json:"sw-one-minute"`
+	SwFiveMinute    *float64    `json:"sw-five-minute"`
+	SwFifteenMinute *float64    `json:"sw-fifteen-minute"`
+}
+
+// UpStream is a single entry of the "upstream" array.
+type UpStream struct {
+	Name          string                 `json:"name"`
+	Src           string                 `json:"src"`
+	OK            interface{}            `json:"ok"`
+	Jobs          interface{}            `json:"jobs"`
+	Fail          interface{}            `json:"fail"`
+	Idling        interface{}            `json:"idling"`
+	Success       interface{}            `json:"success"`
+	Current       interface{}            `json:"current"`
+	OneMinute     *float64               `json:"one-minute"`
+	FiveMinute    *float64               `json:"five-minute"`
+	FifteenMinute *float64               `json:"fifteen-minute"`
+	TrMin         interface{}            `json:"tr-min"`
+	TrMax         interface{}            `json:"tr-max"`
+	TrPercentiles map[string]interface{} `json:"tr-percentiles"`
+}
+
+// FrontStream is a single entry of the "frontstream" array.
+type FrontStream struct {
+	Name          string      `json:"name"`
+	OK            interface{} `json:"ok"`
+	Jobs          interface{} `json:"jobs"`
+	Fail          interface{} `json:"fail"`
+	OneMinute     *float64    `json:"one-minute"`
+	FiveMinute    *float64    `json:"five-minute"`
+	FifteenMinute *float64    `json:"fifteen-minute"`
+}
+
+// DownStream is a single entry of the "downsteram" array. Besides its named
+// fields, mgd emits dynamic "code-<status>" and "fbs-<name>" keys alongside
+// them, which UnmarshalJSON peels off into Codes and FBS.
+type DownStream struct {
+	Name          string                 `json:"name"`
+	App           string                 `json:"app"`
+	OK            interface{}            `json:"ok"`
+	Jobs          interface{}            `json:"jobs"`
+	Fail          interface{}            `json:"fail"`
+	Success       interface{}            `json:"success"`
+	Current       interface{}            `json:"current"`
+	OneMinute     *float64               `json:"one-minute"`
+	FiveMinute    *float64               `json:"five-minute"`
+	FifteenMinute *float64               `json:"fifteen-minute"`
+	TrMin         interface{}            `json:"tr-min"`
+	TrMax         interface{}            `json:"tr-max"`
+	TrPercentiles map[string]interface{} `json:"tr-percentiles"`
+
+	Codes map[string]map[string]interface{} `json:"-"`
+	FBS   map[string]map[string]interface{} `json:"-"`
+}
+
+// UnmarshalJSON decodes the named fields as usual, then scavenges the
+// remaining "code-*" and "fbs-*" keys into Codes and FBS.
+func (d *DownStream) UnmarshalJSON(b []byte) error {
+	type plain DownStream
+	if err := json.Unmarshal(b, (*plain)(d)); err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	for key, v := range raw {
+		var dest *map[string]map[string]interface{}
+		var name string
+		switch {
+		case strings.HasPrefix(key, "code-"):
+			dest, name = &d.Codes, strings.TrimPrefix(key, "code-")
+		case strings.HasPrefix(key, "fbs-"):
+			dest, name = &d.FBS, strings.TrimPrefix(key, "fbs-")
+		default:
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(v, &fields); err != nil {
+			continue
+		}
+		if *dest == nil {
+			*dest = map[string]map[string]interface{}{}
+		}
+		(*dest)[name] = fields
+	}
+	return nil
+}
+
 type MgdStatus struct {
-	Server        ServerStatus             `json:"server"`
-	Downsteram    []map[string]interface{} `json:"downsteram"`
-	Upstream      []map[string]interface{} `json:"upstream"`
-	Inversestream []map[string]interface{} `json:"inversestream"`
-	Frontstream   []map[string]interface{} `json:"frontstream"`
+	Server        ServerStatus    `json:"server"`
+	Downsteram    []DownStream    `json:"downsteram"`
+	Upstream      []UpStream      `json:"upstream"`
+	Inversestream []InverseStream `json:"inversestream"`
+	Frontstream   []FrontStream   `json:"frontstream"`
+}
+
+// UnmarshalJSON decodes MgdStatus, additionally accepting "downstream" as an
+// alias for "downsteram" (sic), since some mgd versions use the corrected
+// spelling.
+func (s *MgdStatus) UnmarshalJSON(b []byte) error {
+	type plain MgdStatus
+	aux := struct {
+		Downstream []DownStream `json:"downstream"`
+		*plain
+	}{plain: (*plain)(s)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	if len(s.Downsteram) == 0 && len(aux.Downstream) > 0 {
+		s.Downsteram = aux.Downstream
+	}
+	return nil
 }
 
 var sampleConfig = `
   ## An array of address to gather stats about. Specify an ip on hostname
   ## with optional port. ie localhost, 10.0.0.1:50000, etc.
   servers = ["localhost:50000"]
+
+  ## Maximum time to wait for a response from a server.
+  # response_timeout = "5s"
+
+  ## Scheme to use for requests, "http" or "https".
+  # scheme = "http"
+
+  ## Optional HTTP Basic Auth credentials.
+  # username = "telegraf"
+  # password = "pa$$word"
+
+  ## Optional TLS config for use with "https" scheme.
+  # tls_ca = "/etc/telegraf/ca.pem"
+  # tls_cert = "/etc/telegraf/cert.pem"
+  # tls_key = "/etc/telegraf/key.pem"
+  ## Use TLS but skip chain & host verification.
+  # insecure_skip_verify = false
+
+  ## tr-percentiles to emit as upstream_latency / downsteram_latency fields.
+  # percentiles = ["50", "75", "95", "99", "999"]
 `
 
 var defaultTimeout = 5 * time.Second
 
+var defaultPercentiles = []string{"50", "75", "95", "99", "999"}
+
 // SampleConfig returns sample configuration message
 func (m *Mgd) SampleConfig() string {
 	return sampleConfig
@@ -49,17 +213,51 @@ func (m *Mgd) Description() string {
 	return "Read metrics from one or many mgd servers"
 }
 
-// Gather reads stats from all configured servers accumulates stats
+// Init sets up the defaults and builds the *http.Client once, rather than
+// on every Gather, so the TLS config is only parsed a single time.
+func (m *Mgd) Init() error {
+	if m.Scheme == "" {
+		m.Scheme = "http"
+	}
+	if m.ResponseTimeout < 1 {
+		m.ResponseTimeout = config.Duration(defaultTimeout)
+	}
+	if len(m.Percentiles) == 0 {
+		m.Percentiles = defaultPercentiles
+	}
+
+	tlsCfg, err := m.ClientConfig.TLSConfig()
+	if err != nil {
+		return err
+	}
+
+	m.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsCfg,
+		},
+		Timeout: time.Duration(m.ResponseTimeout),
+	}
+
+	return nil
+}
+
+// Gather reads stats from all configured servers accumulates stats. Each
+// server is gathered in its own goroutine so a single unreachable or slow
+// mgd doesn't hold up metrics from the rest.
 func (m *Mgd) Gather(acc telegraf.Accumulator) error {
 	if len(m.Servers) == 0 {
-		return m.gatherServer(":50000", acc)
+		m.Servers = []string{":50000"}
 	}
 
+	var wg sync.WaitGroup
 	for _, serverAddress := range m.Servers {
-		if err := m.gatherServer(serverAddress, acc); err != nil {
-			return err
-		}
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			acc.AddError(m.gatherServer(address, acc))
+		}(serverAddress)
 	}
+	wg.Wait()
 
 	return nil
 }
@@ -73,183 +271,206 @@ func (m *Mgd) gatherServer(
 	if err != nil {
 		address = address + ":50000"
 	}
-	resource := fmt.Sprintf("http://%s/", address)
-	res, err := http.Get(resource)
+	resource := fmt.Sprintf("%s://%s/", m.Scheme, address)
+
+	req, err := http.NewRequest("GET", resource, nil)
+	if err != nil {
+		return err
+	}
+	if !m.Username.Empty() {
+		username, err := m.Username.Get()
+		if err != nil {
+			return fmt.Errorf("getting username failed: %w", err)
+		}
+		password, err := m.Password.Get()
+		if err != nil {
+			username.Destroy()
+			return fmt.Errorf("getting password failed: %w", err)
+		}
+		req.SetBasicAuth(username.String(), password.String())
+		username.Destroy()
+		password.Destroy()
+	}
+
+	m.Log.Debugf("fetching %s", resource)
+	res, err := m.client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
+	m.Log.Debugf("got HTTP %d from %s", res.StatusCode, resource)
+	if res.StatusCode != http.StatusOK {
+		err := fmt.Errorf("server %s returned HTTP %d", address, res.StatusCode)
+		m.Log.Errorf("%s", err)
+		return err
+	}
 	mgdStatus, err := parseResponse(res.Body)
 	if err != nil {
+		m.Log.Errorf("parsing response from %s: %s", address, err)
 		return err
 	}
 	// Add server address as a tag
 	tags := map[string]string{"server": address}
 
-	// Process values
-	// fields := make(map[string]interface{})
-	// acc.AddFields("mgd", fields, tags)
-
 	for _, inversestream := range mgdStatus.Inversestream {
-		if err := m.gatherInversestream(tags, inversestream, acc); err != nil {
-			return err
-		}
+		m.gatherInversestream(tags, inversestream, acc)
 	}
 	for _, upstream := range mgdStatus.Upstream {
-		if err := m.gatherUpsteam(tags, upstream, acc); err != nil {
-			return err
-		}
+		m.gatherUpsteam(tags, upstream, acc)
 	}
 	for _, downsteram := range mgdStatus.Downsteram {
-		if err := m.gatherDownsteram(tags, downsteram, acc); err != nil {
-			return err
-		}
+		m.gatherDownsteram(tags, downsteram, acc)
 	}
 	for _, frontstream := range mgdStatus.Frontstream {
-		if err := m.gatherFrontstream(tags, frontstream, acc); err != nil {
-			return err
-		}
+		m.gatherFrontstream(tags, frontstream, acc)
 	}
 
 	return nil
 }
 
+// safeInt returns the int value of v, or reports a missing/malformed field
+// to acc and returns 0 instead of panicking.
+func (m *Mgd) safeInt(acc telegraf.Accumulator, field string, v *float64) int {
+	if v == nil {
+		m.Log.Warnf("missing or non-numeric field %q", field)
+		acc.AddError(fmt.Errorf("mgd: missing or non-numeric field %q", field))
+		return 0
+	}
+	return int(*v)
+}
+
 func (m *Mgd) gatherInversestream(
 	tags map[string]string,
-	status map[string]interface{},
+	status InverseStream,
 	acc telegraf.Accumulator,
-) error {
+) {
 	fields := map[string]interface{}{
-		"ok":                status["ok"],
-		"jobs":              status["jobs"],
-		"one-minute":        int(status["one-minute"].(float64)),
-		"five-minute":       int(status["five-minute"].(float64)),
-		"fifteen-minute":    int(status["fifteen-minute"].(float64)),
-		"sw":                int(status["fifteen-minute"].(float64)),
-		"sw-one-minute":     int(status["sw-one-minute"].(float64)),
-		"sw-five-minute":    int(status["sw-five-minute"].(float64)),
-		"sw-fifteen-minute": int(status["sw-fifteen-minute"].(float64)),
+		"ok":                status.OK,
+		"jobs":              status.Jobs,
+		"one-minute":        m.safeInt(acc, "one-minute", status.OneMinute),
+		"five-minute":       m.safeInt(acc, "five-minute", status.FiveMinute),
+		"fifteen-minute":    m.safeInt(acc, "fifteen-minute", status.FifteenMinute),
+		"sw":                m.safeInt(acc, "fifteen-minute", status.FifteenMinute),
+		"sw-one-minute":     m.safeInt(acc, "sw-one-minute", status.SwOneMinute),
+		"sw-five-minute":    m.safeInt(acc, "sw-five-minute", status.SwFiveMinute),
+		"sw-fifteen-minute": m.safeInt(acc, "sw-fifteen-minute", status.SwFifteenMinute),
 	}
 	accTags := map[string]string{}
 	for k, v := range tags {
 		accTags[k] = v
 	}
-	accTags["name"] = status["name"].(string)
+	accTags["name"] = status.Name
 	acc.AddFields("inversestream", fields, accTags)
-	return nil
+}
+
+// gatherPercentiles emits tr-min, tr-max, and the configured tr-percentiles
+// keys as a separate histogram measurement tagged like its parent stream.
+func (m *Mgd) gatherPercentiles(
+	measurement string,
+	tags map[string]string,
+	percentiles map[string]interface{},
+	trMin, trMax interface{},
+	acc telegraf.Accumulator,
+) {
+	fields := map[string]interface{}{
+		"tr-min": trMin,
+		"tr-max": trMax,
+	}
+	for _, p := range m.Percentiles {
+		fields["tr-"+p] = percentiles[p]
+	}
+	acc.AddHistogram(measurement, fields, tags)
 }
 
 func (m *Mgd) gatherUpsteam(
 	tags map[string]string,
-	status map[string]interface{},
+	status UpStream,
 	acc telegraf.Accumulator,
-) error {
+) {
 	accTags := map[string]string{}
 	for k, v := range tags {
 		accTags[k] = v
 	}
-	accTags["name"] = status["name"].(string)
-	accTags["src"] = status["src"].(string)
+	accTags["name"] = status.Name
+	accTags["src"] = status.Src
 	fields := map[string]interface{}{
-		"ok":             status["ok"],
-		"jobs":           status["jobs"],
-		"fail":           status["fail"],
-		"idling":         status["idling"],
-		"success":        status["success"],
-		"current":        status["current"],
-		"one-minute":     int(status["one-minute"].(float64)),
-		"five-minute":    int(status["five-minute"].(float64)),
-		"fifteen-minute": int(status["fifteen-minute"].(float64)),
-		"tr-min":         status["tr-min"],
-		"tr-max":         status["tr-max"],
-	}
-	percentiles := status["tr-percentiles"].(map[string]interface{})
-	fields["tr-50"] = percentiles["50"]
-	fields["tr-75"] = percentiles["75"]
-	fields["tr-95"] = percentiles["95"]
-	fields["tr-99"] = percentiles["99"]
-	fields["tr-999"] = percentiles["999"]
+		"ok":             status.OK,
+		"jobs":           status.Jobs,
+		"fail":           status.Fail,
+		"idling":         status.Idling,
+		"success":        status.Success,
+		"current":        status.Current,
+		"one-minute":     m.safeInt(acc, "one-minute", status.OneMinute),
+		"five-minute":    m.safeInt(acc, "five-minute", status.FiveMinute),
+		"fifteen-minute": m.safeInt(acc, "fifteen-minute", status.FifteenMinute),
+	}
 
 	acc.AddFields("upstream", fields, accTags)
-	return nil
+	m.gatherPercentiles("upstream_latency", accTags, status.TrPercentiles, status.TrMin, status.TrMax, acc)
 }
 
 func (m *Mgd) gatherFrontstream(
 	tags map[string]string,
-	status map[string]interface{},
+	status FrontStream,
 	acc telegraf.Accumulator,
-) error {
+) {
 	accTags := map[string]string{}
 	for k, v := range tags {
 		accTags[k] = v
 	}
 	fields := map[string]interface{}{
-		"ok":             status["ok"],
-		"jobs":           status["jobs"],
-		"fail":           status["fail"],
-		"one-minute":     int(status["one-minute"].(float64)),
-		"five-minute":    int(status["five-minute"].(float64)),
-		"fifteen-minute": int(status["fifteen-minute"].(float64)),
-	}
-	accTags["name"] = status["name"].(string)
+		"ok":             status.OK,
+		"jobs":           status.Jobs,
+		"fail":           status.Fail,
+		"one-minute":     m.safeInt(acc, "one-minute", status.OneMinute),
+		"five-minute":    m.safeInt(acc, "five-minute", status.FiveMinute),
+		"fifteen-minute": m.safeInt(acc, "fifteen-minute", status.FifteenMinute),
+	}
+	accTags["name"] = status.Name
 	acc.AddFields("frontstream", fields, accTags)
-	return nil
 }
 
 func (m *Mgd) gatherDownsteram(
 	tags map[string]string,
-	status map[string]interface{},
+	status DownStream,
 	acc telegraf.Accumulator,
-) error {
+) {
 	accTags := map[string]string{}
 	for k, v := range tags {
 		accTags[k] = v
 	}
-	accTags["name"] = status["name"].(string)
-	accTags["app"] = status["app"].(string)
+	accTags["name"] = status.Name
+	accTags["app"] = status.App
 
 	fields := map[string]interface{}{
-		"ok":             status["ok"],
-		"jobs":           status["jobs"],
-		"fail":           status["fail"],
-		"success":        status["success"],
-		"current":        status["current"],
-		"one-minute":     int(status["one-minute"].(float64)),
-		"five-minute":    int(status["five-minute"].(float64)),
-		"fifteen-minute": int(status["fifteen-minute"].(float64)),
-		"tr-min":         status["tr-min"],
-		"tr-max":         status["tr-max"],
-	}
-	percentiles := status["tr-percentiles"].(map[string]interface{})
-	fields["tr-50"] = percentiles["50"]
-	fields["tr-75"] = percentiles["75"]
-	fields["tr-95"] = percentiles["95"]
-	fields["tr-99"] = percentiles["99"]
-	fields["tr-999"] = percentiles["999"]
-
-	for tag, value := range status {
-		if strings.HasPrefix(tag, "code-") {
-			code := tag[5:]
-			fields := value.(map[string]interface{})
-			tags := map[string]string{}
-			for k, v := range accTags {
-				tags[k] = v
-			}
-			tags["code"] = code
-			acc.AddFields("dsc", fields, tags)
-		} else if strings.HasPrefix(tag, "fbs-") {
-			fbs := tag[4:]
-			fields := value.(map[string]interface{})
-			tags := map[string]string{}
-			for k, v := range accTags {
-				tags[k] = v
-			}
-			tags["fbs"] = fbs
-			acc.AddFields("fbs", fields, tags)
+		"ok":             status.OK,
+		"jobs":           status.Jobs,
+		"fail":           status.Fail,
+		"success":        status.Success,
+		"current":        status.Current,
+		"one-minute":     m.safeInt(acc, "one-minute", status.OneMinute),
+		"five-minute":    m.safeInt(acc, "five-minute", status.FiveMinute),
+		"fifteen-minute": m.safeInt(acc, "fifteen-minute", status.FifteenMinute),
+	}
+
+	for code, codeFields := range status.Codes {
+		codeTags := map[string]string{}
+		for k, v := range accTags {
+			codeTags[k] = v
 		}
+		codeTags["code"] = code
+		acc.AddFields("dsc", codeFields, codeTags)
+	}
+	for fbs, fbsFields := range status.FBS {
+		fbsTags := map[string]string{}
+		for k, v := range accTags {
+			fbsTags[k] = v
+		}
+		fbsTags["fbs"] = fbs
+		acc.AddFields("fbs", fbsFields, fbsTags)
 	}
 	acc.AddFields("downsteram", fields, accTags)
-	return nil
+	m.gatherPercentiles("downsteram_latency", accTags, status.TrPercentiles, status.TrMin, status.TrMax, acc)
 }
 
 func parseResponse(r io.Reader) (*MgdStatus, error) {
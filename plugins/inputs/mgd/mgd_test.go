@@ -0,0 +1,216 @@
+package mgd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/testutil"
+)
+
+func TestGatherIsolatesFailingServer(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"inversestream":[{
+			"name": "im1",
+			"one-minute": 1, "five-minute": 1, "fifteen-minute": 1,
+			"sw-one-minute": 1, "sw-five-minute": 1, "sw-fifteen-minute": 1
+		}]}`))
+	}))
+	defer healthy.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	m := &Mgd{
+		Servers: []string{healthy.Listener.Addr().String(), broken.Listener.Addr().String()},
+		Log:     testutil.Logger{},
+	}
+	if err := m.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	var acc testutil.Accumulator
+	if err := m.Gather(&acc); err != nil {
+		t.Fatalf("Gather returned an unexpected error: %v", err)
+	}
+
+	if len(acc.Errors) == 0 {
+		t.Fatal("expected the broken server to report an error via AddError")
+	}
+	acc.AssertContainsTaggedFields(t, "inversestream", map[string]interface{}{
+		"ok":                nil,
+		"jobs":              nil,
+		"one-minute":        1,
+		"five-minute":       1,
+		"fifteen-minute":    1,
+		"sw":                1,
+		"sw-one-minute":     1,
+		"sw-five-minute":    1,
+		"sw-fifteen-minute": 1,
+	}, map[string]string{"server": healthy.Listener.Addr().String(), "name": "im1"})
+}
+
+func TestGatherInversestreamMissingFieldReportsError(t *testing.T) {
+	m := &Mgd{Log: testutil.Logger{}}
+	var acc testutil.Accumulator
+
+	// "one-minute" and friends are absent, which used to panic on the
+	// type assertion; it should now surface as an AddError instead.
+	status := InverseStream{Name: "im1"}
+	m.gatherInversestream(map[string]string{"server": "a"}, status, &acc)
+
+	if len(acc.Errors) == 0 {
+		t.Fatal("expected missing numeric fields to be reported via AddError")
+	}
+	acc.AssertContainsTaggedFields(t, "inversestream", map[string]interface{}{
+		"ok":                nil,
+		"jobs":              nil,
+		"one-minute":        0,
+		"five-minute":       0,
+		"fifteen-minute":    0,
+		"sw":                0,
+		"sw-one-minute":     0,
+		"sw-five-minute":    0,
+		"sw-fifteen-minute": 0,
+	}, map[string]string{"server": "a", "name": "im1"})
+}
+
+func TestGatherServerSendsBasicAuth(t *testing.T) {
+	var gotUser, gotPass string
+	var gotOK bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPass, gotOK = r.BasicAuth()
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	m := &Mgd{
+		Servers:  []string{server.Listener.Addr().String()},
+		Username: config.NewSecret([]byte("alice")),
+		Password: config.NewSecret([]byte("s3cret")),
+		Log:      testutil.Logger{},
+	}
+	if err := m.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	var acc testutil.Accumulator
+	if err := m.Gather(&acc); err != nil {
+		t.Fatalf("Gather returned an unexpected error: %v", err)
+	}
+	for _, err := range acc.Errors {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if !gotOK {
+		t.Fatal("expected the request to carry HTTP Basic Auth credentials")
+	}
+	if gotUser != "alice" || gotPass != "s3cret" {
+		t.Fatalf("got user/pass %q/%q, want %q/%q", gotUser, gotPass, "alice", "s3cret")
+	}
+}
+
+func TestGatherUpsteamEmitsConfiguredPercentiles(t *testing.T) {
+	m := &Mgd{Log: testutil.Logger{}, Percentiles: []string{"50", "99"}}
+	var acc testutil.Accumulator
+
+	status := UpStream{
+		Name:  "up1",
+		Src:   "src1",
+		TrMin: 1.0,
+		TrMax: 9.0,
+		TrPercentiles: map[string]interface{}{
+			"50": 2.0, "75": 3.0, "95": 5.0, "99": 8.0,
+		},
+	}
+	m.gatherUpsteam(map[string]string{"server": "a"}, status, &acc)
+
+	// Only the configured percentiles should be emitted, not every key
+	// mgd happens to report.
+	acc.AssertContainsTaggedFields(t, "upstream_latency", map[string]interface{}{
+		"tr-min": 1.0,
+		"tr-max": 9.0,
+		"tr-50":  2.0,
+		"tr-99":  8.0,
+	}, map[string]string{"server": "a", "name": "up1", "src": "src1"})
+}
+
+func TestParseResponseDownstreamKeyAlias(t *testing.T) {
+	body := `{
+		"downstream": [{"name": "ds1", "app": "app1"}]
+	}`
+
+	status, err := parseResponse(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(status.Downsteram) != 1 {
+		t.Fatalf("expected the \"downstream\" alias to populate Downsteram, got %d entries", len(status.Downsteram))
+	}
+	if status.Downsteram[0].Name != "ds1" {
+		t.Fatalf("expected name %q, got %q", "ds1", status.Downsteram[0].Name)
+	}
+}
+
+func TestParseResponsePrefersDownsteramKey(t *testing.T) {
+	body := `{
+		"downsteram": [{"name": "ds1"}],
+		"downstream": [{"name": "ds2"}]
+	}`
+
+	status, err := parseResponse(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(status.Downsteram) != 1 || status.Downsteram[0].Name != "ds1" {
+		t.Fatalf("expected \"downsteram\" to take precedence, got %+v", status.Downsteram)
+	}
+}
+
+func TestDownStreamUnmarshalExtractsCodesAndFBS(t *testing.T) {
+	body := `{
+		"name": "ds1",
+		"app": "app1",
+		"code-200": {"count": 5},
+		"fbs-search": {"count": 3}
+	}`
+
+	var ds DownStream
+	if err := json.Unmarshal([]byte(body), &ds); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if ds.Codes["200"]["count"] != float64(5) {
+		t.Fatalf("expected code-200 count 5, got %v", ds.Codes["200"]["count"])
+	}
+	if ds.FBS["search"]["count"] != float64(3) {
+		t.Fatalf("expected fbs-search count 3, got %v", ds.FBS["search"]["count"])
+	}
+}
+
+func TestGatherDownsteramEmitsCodeAndFBSMeasurements(t *testing.T) {
+	m := &Mgd{Log: testutil.Logger{}}
+	var acc testutil.Accumulator
+
+	status := DownStream{
+		Name: "ds1",
+		App:  "app1",
+		Codes: map[string]map[string]interface{}{
+			"200": {"count": 5},
+		},
+		FBS: map[string]map[string]interface{}{
+			"search": {"count": 3},
+		},
+	}
+	m.gatherDownsteram(map[string]string{"server": "a"}, status, &acc)
+
+	acc.AssertContainsTaggedFields(t, "dsc", map[string]interface{}{"count": 5},
+		map[string]string{"server": "a", "name": "ds1", "app": "app1", "code": "200"})
+	acc.AssertContainsTaggedFields(t, "fbs", map[string]interface{}{"count": 3},
+		map[string]string{"server": "a", "name": "ds1", "app": "app1", "fbs": "search"})
+}